@@ -0,0 +1,103 @@
+/*
+Copyright 2017 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forward
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// runEnhancedShim renders enhancedRecordingShim the way
+// startEnhancedRecording does, redirects fd 3 to a file instead of a real
+// telemetry listener, runs cmds under bash with the shim's DEBUG trap
+// installed, and returns every NDJSON line the trap wrote.
+func runEnhancedShim(t *testing.T, cmds ...string) [][]byte {
+	t.Helper()
+
+	out, err := os.CreateTemp("", "enhanced-shim-*.ndjson")
+	if err != nil {
+		t.Fatalf("creating temp file: %v", err)
+	}
+	defer os.Remove(out.Name())
+	out.Close()
+
+	shim := strings.Replace(
+		fmt.Sprintf(enhancedRecordingShim, "HOST", "PORT"),
+		"exec 3<>/dev/tcp/HOST/PORT",
+		"exec 3>"+out.Name(),
+		1,
+	)
+
+	script := shim + "\n" + strings.Join(cmds, "\n") + "\n"
+	cmd := exec.Command("bash", "-c", script)
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("running shim: %v", err)
+	}
+
+	data, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatalf("reading captured events: %v", err)
+	}
+
+	var lines [][]byte
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := append([]byte(nil), scanner.Bytes()...)
+		if len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func TestEnhancedRecordingShimEscapesCommandsForJSON(t *testing.T) {
+	cases := []string{
+		`echo "hi"`,
+		`git commit -m "fix bug"`,
+		"printf 'line one\\nline two'",
+		`echo 'back\slash'`,
+	}
+
+	lines := runEnhancedShim(t, cases...)
+	if len(lines) < len(cases) {
+		t.Fatalf("expected at least %d events, got %d: %q", len(cases), len(lines), lines)
+	}
+
+	seen := make(map[string]bool, len(cases))
+	for _, line := range lines {
+		var fields map[string]interface{}
+		if err := json.Unmarshal(line, &fields); err != nil {
+			t.Errorf("invalid JSON %q: %v", line, err)
+			continue
+		}
+		if argv, ok := fields["argv"].(string); ok {
+			seen[argv] = true
+		}
+	}
+
+	for _, cmd := range cases {
+		if !seen[cmd] {
+			t.Errorf("no event captured argv %q among %q", cmd, lines)
+		}
+	}
+}
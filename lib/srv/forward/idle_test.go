@@ -0,0 +1,61 @@
+/*
+Copyright 2017 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forward
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// fakeSSHChannel is a minimal ssh.Channel for exercising idleTrackingChannel
+// without a real SSH connection.
+type fakeSSHChannel struct {
+	io.Reader
+	io.Writer
+}
+
+func (fakeSSHChannel) Close() error                                   { return nil }
+func (fakeSSHChannel) CloseWrite() error                              { return nil }
+func (fakeSSHChannel) SendRequest(string, bool, []byte) (bool, error) { return false, nil }
+func (fakeSSHChannel) Stderr() io.ReadWriter                          { return nil }
+
+func TestIdleTrackingChannelTracksReadsAndWrites(t *testing.T) {
+	underlying := fakeSSHChannel{Reader: bytes.NewReader([]byte("hello")), Writer: &bytes.Buffer{}}
+	tracked := newIdleTrackingChannel(underlying)
+
+	time.Sleep(10 * time.Millisecond)
+	if tracked.idleFor() < 10*time.Millisecond {
+		t.Errorf("idleFor() should reflect time since construction before any activity")
+	}
+
+	if _, err := tracked.Read(make([]byte, 5)); err != nil {
+		t.Fatalf("Read returned error: %v", err)
+	}
+	if tracked.idleFor() > 5*time.Millisecond {
+		t.Errorf("idleFor() should reset after a Read")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if _, err := tracked.Write([]byte("hi")); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+	if tracked.idleFor() > 5*time.Millisecond {
+		t.Errorf("idleFor() should reset after a Write")
+	}
+}
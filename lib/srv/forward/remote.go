@@ -22,33 +22,73 @@ import (
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 
+	"github.com/gravitational/teleport/lib/auth"
 	"github.com/gravitational/teleport/lib/defaults"
+	"github.com/gravitational/teleport/lib/events"
 	"github.com/gravitational/teleport/lib/srv"
 	"github.com/gravitational/teleport/lib/utils"
 	"github.com/gravitational/trace"
 )
 
+// HostKeyMode controls how newRemoteSession verifies the host key
+// presented by the remote host a forwarding Server connects to.
+type HostKeyMode string
+
+const (
+	// HostKeyModeRequireCA requires the remote host's key to be signed by
+	// the cluster's host CA, so it only accepts nodes enrolled in
+	// Teleport. This is the default.
+	HostKeyModeRequireCA HostKeyMode = "require-ca"
+	// HostKeyModeTOFU accepts an unknown host key the first time it's
+	// seen for a given address, pinning its fingerprint in the cluster
+	// backend and rejecting any later connection whose key doesn't match.
+	HostKeyModeTOFU HostKeyMode = "tofu"
+	// HostKeyModePinned only accepts host keys whose fingerprint was
+	// supplied ahead of time in configuration.
+	HostKeyModePinned HostKeyMode = "pinned"
+)
+
+// remoteSessionConfig bundles the parameters needed to dial and
+// authenticate the connection to the remote host a forwarding Server
+// proxies to.
+type remoteSessionConfig struct {
+	dstAddr      string
+	systemLogin  string
+	userAgent    agent.Agent
+	authHandlers *srv.AuthHandlers
+
+	hostKeyMode        HostKeyMode
+	pinnedFingerprints []string
+	authClient         auth.ClientI
+	emitAuditEvent     func(eventType string, fields events.EventFields)
+}
+
 // newRemoteSession will create and return a *ssh.Client and *ssh.Session
 // with a remote host.
-func newRemoteSession(dstAddr string, systemLogin string, userAgent agent.Agent, authHandlers *srv.AuthHandlers) (*ssh.Client, *ssh.Session, error) {
+func newRemoteSession(cfg remoteSessionConfig) (*ssh.Client, *ssh.Session, error) {
 	// the proxy will use the agent that has been forwarded to it as the auth
 	// method when connecting to the remote host
-	if userAgent == nil {
+	if cfg.userAgent == nil {
 		return nil, nil, trace.AccessDenied("agent must be forwarded to proxy")
 	}
-	authMethod := ssh.PublicKeysCallback(userAgent.Signers)
+	authMethod := ssh.PublicKeysCallback(cfg.userAgent.Signers)
+
+	hostKeyCallback, err := hostKeyCallbackFor(cfg)
+	if err != nil {
+		return nil, nil, trace.Wrap(err)
+	}
 
 	clientConfig := &ssh.ClientConfig{
-		User: systemLogin,
+		User: cfg.systemLogin,
 		Auth: []ssh.AuthMethod{
 			authMethod,
 		},
-		HostKeyCallback: authHandlers.HostKeyAuth,
+		HostKeyCallback: hostKeyCallback,
 		Timeout:         defaults.DefaultDialTimeout,
 	}
 
 	// dial with a timeout
-	client, err := dialTimeout("tcp", dstAddr, clientConfig)
+	client, err := dialTimeout("tcp", cfg.dstAddr, clientConfig)
 	if err != nil {
 		return nil, nil, trace.Wrap(err)
 	}
@@ -61,6 +101,72 @@ func newRemoteSession(dstAddr string, systemLogin string, userAgent agent.Agent,
 	return client, session, nil
 }
 
+// hostKeyCallbackFor builds the ssh.HostKeyCallback matching cfg's
+// HostKeyMode, defaulting to HostKeyModeRequireCA.
+func hostKeyCallbackFor(cfg remoteSessionConfig) (ssh.HostKeyCallback, error) {
+	switch cfg.hostKeyMode {
+	case "", HostKeyModeRequireCA:
+		return cfg.authHandlers.HostKeyAuth, nil
+	case HostKeyModeTOFU:
+		return tofuHostKeyCallback(cfg), nil
+	case HostKeyModePinned:
+		return pinnedHostKeyCallback(cfg), nil
+	default:
+		return nil, trace.BadParameter("unknown host key mode: %v", cfg.hostKeyMode)
+	}
+}
+
+// tofuHostKeyCallback accepts a host key the first time it's seen for
+// cfg.dstAddr, pinning its fingerprint in the cluster backend, and rejects
+// any later connection whose key doesn't match the pinned fingerprint.
+func tofuHostKeyCallback(cfg remoteSessionConfig) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		fingerprint := ssh.FingerprintSHA256(key)
+
+		known, err := cfg.authClient.GetTrustedHostKeyFingerprint(cfg.dstAddr)
+		if trace.IsNotFound(err) {
+			if err := cfg.authClient.UpsertTrustedHostKeyFingerprint(cfg.dstAddr, fingerprint); err != nil {
+				return trace.Wrap(err)
+			}
+			cfg.emitAuditEvent(events.HostKeyTOFUEvent, events.EventFields{
+				events.PortForwardAddr:    cfg.dstAddr,
+				events.HostKeyFingerprint: fingerprint,
+			})
+			return nil
+		}
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		if known != fingerprint {
+			cfg.emitAuditEvent(events.HostKeyMismatchEvent, events.EventFields{
+				events.PortForwardAddr:    cfg.dstAddr,
+				events.HostKeyFingerprint: fingerprint,
+				"expected-fingerprint":    known,
+			})
+			return trace.AccessDenied("host key for %v does not match the pinned fingerprint", cfg.dstAddr)
+		}
+		return nil
+	}
+}
+
+// pinnedHostKeyCallback only accepts host keys whose fingerprint appears
+// in cfg.pinnedFingerprints.
+func pinnedHostKeyCallback(cfg remoteSessionConfig) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		fingerprint := ssh.FingerprintSHA256(key)
+		for _, pinned := range cfg.pinnedFingerprints {
+			if pinned == fingerprint {
+				return nil
+			}
+		}
+		cfg.emitAuditEvent(events.HostKeyMismatchEvent, events.EventFields{
+			events.PortForwardAddr:    cfg.dstAddr,
+			events.HostKeyFingerprint: fingerprint,
+		})
+		return trace.AccessDenied("host key for %v is not in the pinned fingerprint list", cfg.dstAddr)
+	}
+}
+
 // dialTimeout will both Dial (with a timeout) as well as place a timeout on
 // read/write on the underlying net.Conn.
 func dialTimeout(network, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
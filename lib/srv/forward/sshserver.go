@@ -17,11 +17,19 @@ limitations under the License.
 package forward
 
 import (
+	"bufio"
 	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
@@ -30,6 +38,7 @@ import (
 	"github.com/gravitational/teleport/lib/auth"
 	"github.com/gravitational/teleport/lib/defaults"
 	"github.com/gravitational/teleport/lib/events"
+	"github.com/gravitational/teleport/lib/services"
 	"github.com/gravitational/teleport/lib/session"
 	"github.com/gravitational/teleport/lib/srv"
 	"github.com/gravitational/teleport/lib/sshutils"
@@ -81,6 +90,40 @@ type Server struct {
 	authService     auth.AccessPoint
 	sessionRegistry *srv.SessionRegistry
 	sessionServer   session.Service
+
+	// streamLocalListenersMu guards streamLocalListeners.
+	streamLocalListenersMu sync.Mutex
+	// streamLocalListeners tracks the Unix socket paths the remote host has
+	// been asked to listen on via streamlocal-forward@openssh.com, so they
+	// can be torn down if the client disconnects without cancelling them.
+	streamLocalListeners map[string]bool
+
+	// recorder is the pluggable backend session chunks are ultimately
+	// written to (local disk, S3, GCS, ...).
+	recorder srv.SessionRecorder
+	// chunks decouples the SSH data path from recorder, buffering chunks in
+	// memory and flushing them in the background so a slow or unavailable
+	// backend never blocks a copy loop.
+	chunks *sessionChunkFlusher
+
+	hostKeyMode        HostKeyMode
+	pinnedFingerprints []string
+
+	// x11CookiesMu guards x11Cookies.
+	x11CookiesMu sync.Mutex
+	// x11Cookies maps a spoofed MIT-MAGIC-COOKIE-1 (handed to the remote
+	// host) back to the real cookie the client's X server expects, so
+	// handleX11Channel can rewrite the cookie in the X11 handshake.
+	x11Cookies map[string]string
+
+	enhancedRecording bool
+
+	// enhancedSubscribersMu guards enhancedSubscribers.
+	enhancedSubscribersMu sync.Mutex
+	// enhancedSubscribers are "x-teleport-enhanced-events" channels opened
+	// by Teleport-aware clients to receive the raw NDJSON telemetry stream
+	// as it's produced, in addition to it being audit logged.
+	enhancedSubscribers []ssh.Channel
 }
 
 // ServerConfig is the configuration needed to create an instance of a Server.
@@ -90,6 +133,26 @@ type ServerConfig struct {
 	Source          string
 	Destination     string
 	HostCertificate ssh.Signer
+
+	// Recorder is the backend session chunks are written to. If unset, it
+	// defaults to a recorder backed by AuthClient's audit log.
+	Recorder srv.SessionRecorder
+	// SpoolDir is where session chunks are persisted when Recorder can't
+	// accept them, to be retried later. Defaults to defaults.DataDir/spool.
+	SpoolDir string
+
+	// HostKeyMode controls how the remote host's key is verified. If
+	// empty, the cluster-wide default is used, falling back to
+	// HostKeyModeRequireCA.
+	HostKeyMode HostKeyMode
+	// PinnedFingerprints is the list of SHA256 host key fingerprints
+	// accepted when HostKeyMode is HostKeyModePinned.
+	PinnedFingerprints []string
+
+	// EnhancedRecording enables command/disk/network telemetry for shell
+	// and exec sessions proxied to OpenSSH nodes, where BPF-based
+	// enhanced recording isn't available.
+	EnhancedRecording bool
 }
 
 // CheckDefaults makes sure all required parameters are passed in.
@@ -145,16 +208,42 @@ func New(c ServerConfig) (*Server, error) {
 				"dst-addr": c.Destination,
 			},
 		}),
-		agent:           c.UserAgent,
-		hostCertificate: c.HostCertificate,
-		authClient:      c.AuthClient,
-		auditLog:        c.AuthClient,
-		authService:     c.AuthClient,
-		sessionServer:   c.AuthClient,
-		serverConn:      serverConn,
-		clientConn:      clientConn,
+		agent:                c.UserAgent,
+		hostCertificate:      c.HostCertificate,
+		authClient:           c.AuthClient,
+		auditLog:             c.AuthClient,
+		authService:          c.AuthClient,
+		sessionServer:        c.AuthClient,
+		serverConn:           serverConn,
+		clientConn:           clientConn,
+		streamLocalListeners: make(map[string]bool),
+		hostKeyMode:          c.HostKeyMode,
+		pinnedFingerprints:   c.PinnedFingerprints,
+		x11Cookies:           make(map[string]string),
+		enhancedRecording:    c.EnhancedRecording,
+	}
+
+	// fall back to the cluster-wide default when the caller didn't pin a
+	// mode for this particular connection.
+	if s.hostKeyMode == "" {
+		if clusterConfig, err := c.AuthClient.GetClusterConfig(); err == nil {
+			s.hostKeyMode = HostKeyMode(clusterConfig.GetHostKeyMode())
+		}
+	}
+	if s.hostKeyMode == "" {
+		s.hostKeyMode = HostKeyModeRequireCA
 	}
 
+	s.recorder = c.Recorder
+	if s.recorder == nil {
+		s.recorder = srv.NewAuditSessionRecorder(c.AuthClient)
+	}
+	spoolDir := c.SpoolDir
+	if spoolDir == "" {
+		spoolDir = filepath.Join(defaults.DataDir, "spool")
+	}
+	s.chunks = newSessionChunkFlusher(s.log, s.recorder, spoolDir)
+
 	s.sessionRegistry = srv.NewSessionRegistry(s)
 
 	// common auth handlers
@@ -253,7 +342,16 @@ func (s *Server) Serve() {
 
 	// build a remote session to the remote node
 	s.log.Debugf("Creating remote connection to %v@%v", sconn.User(), s.clientConn.RemoteAddr().String())
-	s.remoteClient, s.remoteSession, err = newRemoteSession(s.clientConn.RemoteAddr().String(), sconn.User(), s.agent, s.authHandlers)
+	s.remoteClient, s.remoteSession, err = newRemoteSession(remoteSessionConfig{
+		dstAddr:            s.clientConn.RemoteAddr().String(),
+		systemLogin:        sconn.User(),
+		userAgent:          s.agent,
+		authHandlers:       s.authHandlers,
+		hostKeyMode:        s.hostKeyMode,
+		pinnedFingerprints: s.pinnedFingerprints,
+		authClient:         s.authClient,
+		emitAuditEvent:     s.EmitAuditEvent,
+	})
 	if err != nil {
 		defer s.serverConn.Close()
 		defer s.clientConn.Close()
@@ -267,6 +365,11 @@ func (s *Server) Serve() {
 		return
 	}
 
+	// the remote host opens "x11" channels back through this same SSH
+	// connection when a forwarded X11 client connects there; service them
+	// as they arrive for the life of the connection.
+	go s.handleX11Channels(sconn, s.remoteClient.HandleChannelOpen("x11"))
+
 	// process global and channel requests
 	go s.handleConnection(sconn, chans, reqs)
 }
@@ -278,6 +381,8 @@ func (s *Server) handleConnection(sconn *ssh.ServerConn, chans <-chan ssh.NewCha
 		case newRequest := <-reqs:
 			if newRequest == nil {
 				s.log.Debugf("Closing connection to %v", sconn.RemoteAddr())
+				s.teardownStreamLocalListeners()
+				s.closeChunks()
 				return
 			}
 			go s.handleGlobalRequest(newRequest)
@@ -285,6 +390,8 @@ func (s *Server) handleConnection(sconn *ssh.ServerConn, chans <-chan ssh.NewCha
 		case newChannel := <-chans:
 			if newChannel == nil {
 				s.log.Debugf("Closing connection to %v", sconn.RemoteAddr())
+				s.teardownStreamLocalListeners()
+				s.closeChunks()
 				return
 			}
 			go s.handleChannel(sconn, newChannel)
@@ -308,6 +415,14 @@ func (s *Server) handleGlobalRequest(req *ssh.Request) {
 		s.log.Warnf("Failed to forward global request %v: %v", req.Type, err)
 		return
 	}
+
+	// track streamlocal-forward@openssh.com listeners so they can be torn
+	// down on the remote host if the client disconnects without explicitly
+	// cancelling them.
+	if ok {
+		s.trackStreamLocalListener(req)
+	}
+
 	if req.WantReply {
 		err = req.Reply(ok, nil)
 		if err != nil {
@@ -316,6 +431,56 @@ func (s *Server) handleGlobalRequest(req *ssh.Request) {
 	}
 }
 
+// trackStreamLocalListener records or forgets a streamlocal-forward@openssh.com
+// listener path so teardownStreamLocalListeners can clean it up on disconnect.
+func (s *Server) trackStreamLocalListener(req *ssh.Request) {
+	var r streamLocalForwardReq
+	if err := ssh.Unmarshal(req.Payload, &r); err != nil {
+		s.log.Warnf("Failed to parse %v request: %v", req.Type, err)
+		return
+	}
+
+	s.streamLocalListenersMu.Lock()
+	defer s.streamLocalListenersMu.Unlock()
+
+	switch req.Type {
+	case streamLocalForwardRequest:
+		s.streamLocalListeners[r.SocketPath] = true
+	case cancelStreamLocalForwardRequest:
+		delete(s.streamLocalListeners, r.SocketPath)
+	}
+}
+
+// teardownStreamLocalListeners asks the remote host to cancel every
+// streamlocal-forward@openssh.com listener still registered for this
+// connection, so a disconnecting OpenSSH client doesn't leak Unix sockets
+// on the target host.
+func (s *Server) teardownStreamLocalListeners() {
+	s.streamLocalListenersMu.Lock()
+	paths := make([]string, 0, len(s.streamLocalListeners))
+	for path := range s.streamLocalListeners {
+		paths = append(paths, path)
+	}
+	s.streamLocalListeners = make(map[string]bool)
+	s.streamLocalListenersMu.Unlock()
+
+	for _, path := range paths {
+		payload := ssh.Marshal(streamLocalForwardReq{SocketPath: path})
+		if _, err := s.remoteSession.SendRequest(cancelStreamLocalForwardRequest, false, payload); err != nil {
+			s.log.Warnf("Failed to cancel stream-local listener %v: %v", path, err)
+		}
+	}
+}
+
+// closeChunks stops s.chunks, spooling any chunks still buffered in memory
+// and closing the underlying recorder, so a disconnecting client doesn't
+// leak the flusher's background goroutine or lose unflushed recordings.
+func (s *Server) closeChunks() {
+	if err := s.chunks.Close(); err != nil {
+		s.log.Warnf("Failed to close session chunk flusher: %v", err)
+	}
+}
+
 func (s *Server) handleChannel(sconn *ssh.ServerConn, nch ssh.NewChannel) {
 	channelType := nch.ChannelType()
 
@@ -325,6 +490,15 @@ func (s *Server) handleChannel(sconn *ssh.ServerConn, nch ssh.NewChannel) {
 	case "x-teleport-request-resize-events":
 		ch, _, _ := nch.Accept()
 		go s.handleTerminalResize(sconn, ch)
+	// a client requested the raw enhanced recording telemetry stream
+	// (command/disk/network NDJSON events) as it's produced
+	case "x-teleport-enhanced-events":
+		ch, _, err := nch.Accept()
+		if err != nil {
+			s.log.Infof("Unable to accept channel: %v", err)
+			return
+		}
+		s.addEnhancedSubscriber(ch)
 	// interactive sessions
 	case "session":
 		ch, requests, err := nch.Accept()
@@ -344,6 +518,19 @@ func (s *Server) handleChannel(sconn *ssh.ServerConn, nch ssh.NewChannel) {
 			s.log.Infof("Unable to accept channel: %v", err)
 		}
 		go s.handleDirectTCPIPRequest(sconn, ch, req)
+	// Unix domain socket forwarding (OpenSSH extension)
+	case directStreamLocalChannel:
+		var req directStreamLocalReq
+		if err := ssh.Unmarshal(nch.ExtraData(), &req); err != nil {
+			s.log.Errorf("Failed to parse request data: %v, err: %v", string(nch.ExtraData()), err)
+			nch.Reject(ssh.UnknownChannelType, "failed to parse direct-streamlocal request")
+			return
+		}
+		ch, _, err := nch.Accept()
+		if err != nil {
+			s.log.Infof("Unable to accept channel: %v", err)
+		}
+		go s.handleDirectStreamLocalRequest(sconn, ch, &req)
 	default:
 		nch.Reject(ssh.UnknownChannelType, fmt.Sprintf("unknown channel type: %v", channelType))
 	}
@@ -368,6 +555,15 @@ func (s *Server) handleDirectTCPIPRequest(sconn *ssh.ServerConn, ch ssh.Channel,
 	defer ctx.Close()
 
 	addr := fmt.Sprintf("%v:%d", req.Host, req.Port)
+
+	// enforce the per-user allow/deny list of host:port patterns before we
+	// ever dial out, so a denied destination is never reached.
+	if err := s.authHandlers.CheckPortForward(addr, ctx); err != nil {
+		ctx.Warningf("Denied port forwarding to %v: %v", addr, err)
+		s.rejectPortForward(ch, err)
+		return
+	}
+
 	ctx.Infof("direct-tcpip channel: %#v to --> %v", req, addr)
 	conn, err := net.Dial("tcp", addr)
 	if err != nil {
@@ -384,21 +580,214 @@ func (s *Server) handleDirectTCPIPRequest(sconn *ssh.ServerConn, ch ssh.Channel,
 		events.RemoteAddr:      sconn.RemoteAddr().String(),
 	})
 
+	// received and sent each get their own recorder so the two io.Copy
+	// goroutines below never share a chunk counter -- a single shared
+	// counter would race, and would also interleave the two streams under
+	// one numbering, defeating reassembly in order.
+	receivedRecorder := newPortForwardRecorder(s, ctx, addr, "received")
+	sentRecorder := newPortForwardRecorder(s, ctx, addr, "sent")
+	start := time.Now()
+	closeReason := "completed"
+	var sent, received int64
+
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		io.Copy(ch, conn)
+		n, err := io.Copy(receivedRecorder.tap(ch), conn)
+		received = n
+		if err != nil {
+			closeReason = "error"
+		}
 		ch.Close()
 	}()
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		io.Copy(conn, ch)
+		n, err := io.Copy(sentRecorder.tap(conn), ch)
+		sent = n
+		if err != nil {
+			closeReason = "error"
+		}
 		conn.Close()
 	}()
 
 	wg.Wait()
+
+	// emit a structured close event with byte counts, duration, and why the
+	// forwarded channel went away, mirroring the bookkeeping kept for
+	// tracked remote-forward listeners.
+	s.EmitAuditEvent(events.PortForwardEndEvent, events.EventFields{
+		events.PortForwardAddr: addr,
+		events.EventLogin:      ctx.Login,
+		events.BytesSent:       sent,
+		events.BytesReceived:   received,
+		events.Duration:        time.Since(start),
+		events.Reason:          closeReason,
+	})
+}
+
+// rejectPortForward writes a user-visible SSH error message to the channel
+// and delivers a failure exit-status, since the channel has already been
+// accepted by the time the RBAC check runs.
+func (s *Server) rejectPortForward(ch ssh.Channel, err error) {
+	ch.Stderr().Write([]byte(utils.UserMessageFromError(err)))
+	_, sendErr := ch.SendRequest("exit-status", false, ssh.Marshal(struct{ C uint32 }{C: teleport.RemoteCommandFailure}))
+	if sendErr != nil {
+		s.log.Warnf("Failed to send exit status for denied port forward: %v", sendErr)
+	}
+}
+
+// portForwardRecorder optionally mirrors one direction of a forwarded
+// TCP/IP stream into the audit log as chunked events, when the user's role
+// has record_port_forwards enabled. Each direction of a forwarded channel
+// gets its own recorder and its own chunk counter -- index is not safe for
+// concurrent use, and handleDirectTCPIPRequest drives the two directions
+// from separate goroutines.
+type portForwardRecorder struct {
+	server    *Server
+	ctx       *srv.ServerContext
+	addr      string
+	direction string
+	enabled   bool
+	index     int
+}
+
+func newPortForwardRecorder(s *Server, ctx *srv.ServerContext, addr, direction string) *portForwardRecorder {
+	return &portForwardRecorder{
+		server:    s,
+		ctx:       ctx,
+		addr:      addr,
+		direction: direction,
+		enabled:   ctx.Identity.RoleSet.RecordPortForwards(),
+	}
+}
+
+// tap returns dst unchanged unless full-stream capture is enabled for the
+// connecting user's role, in which case every write is also mirrored into
+// the audit log as a chunked event.
+func (r *portForwardRecorder) tap(dst io.Writer) io.Writer {
+	if !r.enabled {
+		return dst
+	}
+	return io.MultiWriter(dst, r)
+}
+
+// Write implements io.Writer, queueing each chunk of a recorded port
+// forward for asynchronous delivery to the session recorder, numbered so
+// the chunks can be reassembled in order.
+func (r *portForwardRecorder) Write(p []byte) (int, error) {
+	r.index++
+	r.server.chunks.Write(srv.SessionChunk{
+		Data:       append([]byte(nil), p...),
+		EventIndex: int64(r.index),
+		EventType:  events.PortForwardChunkEvent,
+		Fields: events.EventFields{
+			events.PortForwardAddr: r.addr,
+			events.EventLogin:      r.ctx.Login,
+			"direction":            r.direction,
+		},
+	})
+	return len(p), nil
+}
+
+const (
+	// directStreamLocalChannel is the OpenSSH channel type used to open a
+	// Unix domain socket forwarded through the recording proxy.
+	directStreamLocalChannel = "direct-streamlocal@openssh.com"
+	// streamLocalForwardRequest asks the remote host to start listening on
+	// a Unix domain socket and forward connections back as
+	// forwarded-streamlocal@openssh.com channels.
+	streamLocalForwardRequest = "streamlocal-forward@openssh.com"
+	// cancelStreamLocalForwardRequest cancels a previously registered
+	// streamLocalForwardRequest listener.
+	cancelStreamLocalForwardRequest = "cancel-streamlocal-forward@openssh.com"
+)
+
+// directStreamLocalReq is the OpenSSH direct-streamlocal@openssh.com
+// channel payload: the target socket path followed by two reserved fields.
+type directStreamLocalReq struct {
+	SocketPath string
+	Reserved1  string
+	Reserved2  uint32
+}
+
+// streamLocalForwardReq is the OpenSSH streamlocal-forward@openssh.com /
+// cancel-streamlocal-forward@openssh.com global request payload.
+type streamLocalForwardReq struct {
+	SocketPath string
+}
+
+// handleDirectStreamLocalRequest handles Unix domain socket forwarding
+// requests, opening the socket on the remote (target) host rather than on
+// the proxy itself. It applies the same allow/deny check as
+// handleDirectTCPIPRequest and emits a UnixForwardEvent once the socket is
+// open; it emits no end event with byte counts, duration or close reason,
+// and does not capture stream contents.
+func (s *Server) handleDirectStreamLocalRequest(sconn *ssh.ServerConn, ch ssh.Channel, req *directStreamLocalReq) {
+	ctx := srv.NewServerContext(s, sconn)
+
+	ctx.RemoteClient = s.remoteClient
+	ctx.RemoteSession = s.remoteSession
+	ctx.SetAgent(s.agent, s.agentChannel)
+
+	ctx.AddCloser(ch)
+	ctx.AddCloser(sconn)
+	ctx.AddCloser(s.serverConn)
+	ctx.AddCloser(s.clientConn)
+	ctx.AddCloser(s.remoteSession)
+	ctx.AddCloser(s.remoteClient)
+
+	defer ctx.Debugf("Closed direct-streamlocal context")
+	defer ctx.Close()
+
+	// enforce the same per-user allow/deny list checked before dialing a
+	// direct-tcpip destination, so a role that denies port forwarding also
+	// denies forwarding to a Unix socket on the target host.
+	if err := s.authHandlers.CheckPortForward(req.SocketPath, ctx); err != nil {
+		ctx.Warningf("Denied streamlocal forwarding to %v: %v", req.SocketPath, err)
+		s.rejectPortForward(ch, err)
+		return
+	}
+
+	ctx.Infof("direct-streamlocal channel: %#v to --> %v", req, req.SocketPath)
+
+	// ssh.Client.Dial always parses addr with net.SplitHostPort regardless
+	// of the network string, so it can never open a filesystem path. Open
+	// a real direct-streamlocal@openssh.com channel on the remote
+	// connection instead, which is how OpenSSH itself opens the socket on
+	// the target host.
+	payload := ssh.Marshal(directStreamLocalReq{SocketPath: req.SocketPath})
+	remoteCh, remoteReqs, err := s.remoteClient.OpenChannel(directStreamLocalChannel, payload)
+	if err != nil {
+		ctx.Infof("Failed connecting to: %v, err: %v", req.SocketPath, err)
+		return
+	}
+	defer remoteCh.Close()
+	go ssh.DiscardRequests(remoteReqs)
+
+	s.EmitAuditEvent(events.UnixForwardEvent, events.EventFields{
+		events.UnixSocketPath: req.SocketPath,
+		events.EventLogin:     ctx.Login,
+		events.LocalAddr:      sconn.LocalAddr().String(),
+		events.RemoteAddr:     sconn.RemoteAddr().String(),
+	})
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		io.Copy(ch, remoteCh)
+		ch.Close()
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		io.Copy(remoteCh, ch)
+		remoteCh.Close()
+	}()
+
+	wg.Wait()
 }
 
 // handleTerminalResize is called by the web proxy via its SSH connection.
@@ -423,6 +812,10 @@ func (s *Server) handleSessionRequests(sconn *ssh.ServerConn, ch ssh.Channel, in
 	ctx.RemoteClient = s.remoteClient
 	ctx.RemoteSession = s.remoteSession
 	ctx.SetAgent(s.agent, s.agentChannel)
+	// PTY and other session chunks are written through the async flusher
+	// rather than directly to the recorder, so a slow backend never stalls
+	// the SSH data path.
+	ctx.SetSessionRecorder(s.chunks)
 
 	ctx.AddCloser(ch)
 	ctx.AddCloser(sconn)
@@ -434,6 +827,15 @@ func (s *Server) handleSessionRequests(sconn *ssh.ServerConn, ch ssh.Channel, in
 	defer s.log.Debugf("Closed session context")
 	defer ctx.Close()
 
+	// track activity on the client-facing channel so idle sessions can be
+	// enforced independently of whatever idle timeout applies upstream.
+	tracked := newIdleTrackingChannel(ch)
+
+	terminate := make(chan string, 1)
+	stopMonitor := make(chan struct{})
+	defer close(stopMonitor)
+	go s.monitorSession(ctx, tracked, terminate, stopMonitor)
+
 	for {
 		// update ctx with the session ID:
 		err := ctx.CreateOrJoinSession(s.sessionRegistry)
@@ -456,14 +858,17 @@ func (s *Server) handleSessionRequests(sconn *ssh.ServerConn, ch ssh.Channel, in
 			// want us to close session and the channel
 			ctx.Debugf("Subsystem execution result: %v", result.Err)
 			return
+		case reason := <-terminate:
+			s.terminateSession(ctx, tracked, reason)
+			return
 		case req := <-in:
 			if req == nil {
 				// this will happen when the client closes/drops the connection
 				ctx.Debugf("Client %v disconnected", sconn.RemoteAddr())
 				return
 			}
-			if err := s.dispatch(ch, req, ctx); err != nil {
-				s.replyError(ch, req, err)
+			if err := s.dispatch(tracked, req, ctx); err != nil {
+				s.replyError(tracked, req, err)
 				return
 			}
 			if req.WantReply {
@@ -488,10 +893,20 @@ func (s *Server) dispatch(ch ssh.Channel, req *ssh.Request, ctx *srv.ServerConte
 
 	switch req.Type {
 	case sshutils.ExecRequest:
+		if s.enhancedRecordingEnabled(ctx) {
+			if err := s.wrapExecForEnhancedRecording(req, ctx); err != nil {
+				ctx.Warningf("Failed to enable enhanced recording for exec: %v", err)
+			}
+		}
 		return s.termHandlers.HandleExec(ch, req, ctx)
 	case sshutils.PTYRequest:
 		return s.termHandlers.HandlePTYReq(ch, req, ctx)
 	case sshutils.ShellRequest:
+		if s.enhancedRecordingEnabled(ctx) {
+			if err := s.wrapShellForEnhancedRecording(ctx); err != nil {
+				ctx.Warningf("Failed to enable enhanced recording for shell: %v", err)
+			}
+		}
 		return s.termHandlers.HandleShell(ch, req, ctx)
 	case sshutils.WindowChangeRequest:
 		return s.termHandlers.HandleWinChange(ch, req, ctx)
@@ -508,6 +923,8 @@ func (s *Server) dispatch(ch ssh.Channel, req *ssh.Request, ctx *srv.ServerConte
 			s.log.Info(err)
 		}
 		return nil
+	case sshutils.X11ForwardRequest:
+		return s.handleX11Forward(ch, req, ctx)
 	default:
 		return trace.BadParameter(
 			"%v doesn't support request type '%v'", s.Component(), req.Type)
@@ -536,6 +953,184 @@ func (s *Server) handleAgentForward(ch ssh.Channel, req *ssh.Request, ctx *srv.S
 	return nil
 }
 
+// handleX11Forward handles an x11-req session request: it generates a
+// fresh, spoofed MIT-MAGIC-COOKIE-1, caches the real<->spoofed mapping on
+// the Server (not on the ServerContext), where it is shared by every
+// session of this connection, so handleX11Channel can rewrite it later, and forwards
+// the request upstream with the spoofed cookie so the remote host's
+// $DISPLAY is set up without ever learning the client's real cookie.
+func (s *Server) handleX11Forward(ch ssh.Channel, req *ssh.Request, ctx *srv.ServerContext) error {
+	if err := s.authHandlers.CheckX11Forward(ctx); err != nil {
+		s.replyError(ch, req, err)
+		return trace.Wrap(err)
+	}
+
+	var r sshutils.X11ReqParams
+	if err := ssh.Unmarshal(req.Payload, &r); err != nil {
+		return trace.Wrap(err, "failed to parse x11-req")
+	}
+
+	spoofedCookie, err := newFakeX11Cookie()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	s.cacheX11Cookie(spoofedCookie, r.AuthCookie)
+
+	forwarded := r
+	forwarded.AuthCookie = spoofedCookie
+
+	ok, err := s.remoteSession.SendRequest(req.Type, req.WantReply, ssh.Marshal(forwarded))
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if req.WantReply {
+		if err := req.Reply(ok, nil); err != nil {
+			ctx.Warningf("Failed to reply to x11-req: %v", err)
+		}
+	}
+
+	s.EmitAuditEvent(events.X11ForwardEvent, events.EventFields{
+		events.EventLogin: ctx.Login,
+	})
+
+	return nil
+}
+
+// cacheX11Cookie remembers the real<->spoofed cookie mapping for this
+// connection so a later "x11" channel from the remote host can be
+// rewritten back to the cookie the client's X server expects.
+func (s *Server) cacheX11Cookie(spoofed, real string) {
+	s.x11CookiesMu.Lock()
+	defer s.x11CookiesMu.Unlock()
+	s.x11Cookies[spoofed] = real
+}
+
+// lookupX11Cookie returns the real cookie cached for a spoofed cookie, if
+// any.
+func (s *Server) lookupX11Cookie(spoofed string) (string, bool) {
+	s.x11CookiesMu.Lock()
+	defer s.x11CookiesMu.Unlock()
+	real, ok := s.x11Cookies[spoofed]
+	return real, ok
+}
+
+// newFakeX11Cookie generates a random 16-byte MIT-MAGIC-COOKIE-1 value,
+// hex-encoded as X11 expects.
+func newFakeX11Cookie() (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", trace.Wrap(err)
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// handleX11Channels services "x11" channels opened by the remote host in
+// response to an earlier x11-req, re-opening a matching "x11" channel
+// toward the downstream client for each one.
+func (s *Server) handleX11Channels(sconn *ssh.ServerConn, chans <-chan ssh.NewChannel) {
+	for nch := range chans {
+		go s.handleX11Channel(sconn, nch)
+	}
+}
+
+// handleX11Channel accepts a single "x11" channel from the remote host,
+// rewrites the spoofed auth cookie in the initial X11 handshake back to
+// the real cookie the client's X server expects, then splices it to a
+// matching "x11" channel opened back to the client.
+func (s *Server) handleX11Channel(sconn *ssh.ServerConn, nch ssh.NewChannel) {
+	remoteCh, remoteReqs, err := nch.Accept()
+	if err != nil {
+		s.log.Warnf("Unable to accept x11 channel: %v", err)
+		return
+	}
+	defer remoteCh.Close()
+	go ssh.DiscardRequests(remoteReqs)
+
+	clientCh, clientReqs, err := sconn.OpenChannel("x11", nch.ExtraData())
+	if err != nil {
+		s.log.Warnf("Unable to open x11 channel to client: %v", err)
+		return
+	}
+	defer clientCh.Close()
+	go ssh.DiscardRequests(clientReqs)
+
+	// read the connection-setup packet (with its spoofed cookie) from the
+	// remote host and write the rewritten packet (with the real cookie)
+	// to the client, which is the X display that actually has to
+	// authenticate it.
+	if err := rewriteX11Cookie(remoteCh, clientCh, s.lookupX11Cookie); err != nil {
+		s.log.Warnf("Failed to rewrite X11 cookie: %v", err)
+		return
+	}
+
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(clientCh, remoteCh)
+		clientCh.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(remoteCh, clientCh)
+		remoteCh.Close()
+	}()
+	wg.Wait()
+}
+
+// rewriteX11Cookie reads the X11 connection setup packet (with its spoofed
+// auth cookie) off src — the channel opened by the remote host — replaces
+// the cookie with the real one the client's X server was configured with,
+// and writes the rewritten packet to dst — the channel forwarded to the
+// client. getReal maps a spoofed hex cookie to the real hex cookie cached
+// for it earlier. Reading and writing different channels here matters:
+// src belongs to the remote peer and is not where the client's X server
+// will ever look for this packet.
+func rewriteX11Cookie(src io.Reader, dst io.Writer, getReal func(spoofed string) (string, bool)) error {
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(src, header); err != nil {
+		return trace.Wrap(err)
+	}
+
+	var byteOrder binary.ByteOrder = binary.BigEndian
+	if header[0] == 'l' {
+		byteOrder = binary.LittleEndian
+	}
+	protoNameLen := byteOrder.Uint16(header[6:8])
+	dataLen := byteOrder.Uint16(header[8:10])
+
+	rest := make([]byte, int(protoNameLen)+pad(int(protoNameLen))+int(dataLen)+pad(int(dataLen)))
+	if _, err := io.ReadFull(src, rest); err != nil {
+		return trace.Wrap(err)
+	}
+
+	dataStart := int(protoNameLen) + pad(int(protoNameLen))
+	spoofed := hex.EncodeToString(rest[dataStart : dataStart+int(dataLen)])
+	if real, ok := getReal(spoofed); ok {
+		realBytes, err := hex.DecodeString(real)
+		if err == nil && len(realBytes) == int(dataLen) {
+			copy(rest[dataStart:dataStart+int(dataLen)], realBytes)
+		}
+	}
+
+	if _, err := dst.Write(header); err != nil {
+		return trace.Wrap(err)
+	}
+	if _, err := dst.Write(rest); err != nil {
+		return trace.Wrap(err)
+	}
+	return nil
+}
+
+// pad returns the number of padding bytes needed to round n up to a
+// multiple of 4, as required by the X11 wire protocol.
+func pad(n int) int {
+	if n%4 == 0 {
+		return 0
+	}
+	return 4 - n%4
+}
+
 func (s *Server) handleSubsystem(ch ssh.Channel, req *ssh.Request, ctx *srv.ServerContext) error {
 	subsystem, err := parseSubsystemRequest(req, ctx)
 	if err != nil {
@@ -564,6 +1159,169 @@ func (s *Server) handleSubsystem(ch ssh.Channel, req *ssh.Request, ctx *srv.Serv
 	return nil
 }
 
+// enhancedRecordingEnabled reports whether command/disk/network telemetry
+// should be collected for this session: the feature must be turned on for
+// this Server and the user's role must permit it.
+func (s *Server) enhancedRecordingEnabled(ctx *srv.ServerContext) bool {
+	if !s.enhancedRecording {
+		return false
+	}
+	if err := s.authHandlers.CheckEnhancedRecording(ctx); err != nil {
+		return false
+	}
+	return true
+}
+
+// addEnhancedSubscriber registers a channel opened by a Teleport-aware
+// client to receive the raw enhanced recording event stream as it's
+// produced.
+func (s *Server) addEnhancedSubscriber(ch ssh.Channel) {
+	s.enhancedSubscribersMu.Lock()
+	defer s.enhancedSubscribersMu.Unlock()
+	s.enhancedSubscribers = append(s.enhancedSubscribers, ch)
+}
+
+// broadcastEnhancedEvent mirrors a raw NDJSON event line to every
+// currently subscribed "x-teleport-enhanced-events" channel.
+func (s *Server) broadcastEnhancedEvent(line []byte) {
+	s.enhancedSubscribersMu.Lock()
+	defer s.enhancedSubscribersMu.Unlock()
+	for _, ch := range s.enhancedSubscribers {
+		ch.Write(line)
+	}
+}
+
+// enhancedRecordingShim is injected ahead of the user's real command. It
+// defines a DEBUG trap that reports every command executed by the shell
+// (argv, pid, ppid, cwd) as NDJSON written to fd 3, which is redirected to
+// the telemetry listener opened for this session. Only command events are
+// produced today; session.disk and session.network stay reserved field
+// names for a future strace-based version of this shim.
+const enhancedRecordingShim = `exec 3<>/dev/tcp/%s/%s
+__teleport_json_escape() {
+  local s=${1//\\/\\\\}
+  s=${s//\"/\\\"}
+  s=${s//$'\n'/\\n}
+  s=${s//$'\r'/\\r}
+  s=${s//$'\t'/\\t}
+  printf '%%s' "$s"
+}
+__teleport_enhanced() {
+  local cmd pwd
+  cmd=$(__teleport_json_escape "$BASH_COMMAND")
+  pwd=$(__teleport_json_escape "$PWD")
+  printf '{"type":"command","argv":"%%s","pid":%%s,"ppid":%%s,"cwd":"%%s"}\n' \
+    "$cmd" "$$" "$PPID" "$pwd" >&3
+}
+trap '__teleport_enhanced' DEBUG
+`
+
+// wrapExecForEnhancedRecording starts the telemetry listener for this
+// session and rewrites an exec request's command to source the enhanced
+// recording shim before running the user's real command.
+func (s *Server) wrapExecForEnhancedRecording(req *ssh.Request, ctx *srv.ServerContext) error {
+	var e sshutils.ExecReqParams
+	if err := ssh.Unmarshal(req.Payload, &e); err != nil {
+		return trace.Wrap(err)
+	}
+
+	shim, err := s.startEnhancedRecording(ctx)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	e.Command = fmt.Sprintf("%s%s", shim, e.Command)
+	req.Payload = ssh.Marshal(e)
+
+	return nil
+}
+
+// wrapShellForEnhancedRecording starts the telemetry listener for this
+// session and arranges for the shim to be sourced when the interactive
+// shell starts, via BASH_ENV.
+func (s *Server) wrapShellForEnhancedRecording(ctx *srv.ServerContext) error {
+	shim, err := s.startEnhancedRecording(ctx)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	shimPath := fmt.Sprintf("/tmp/.teleport-enhanced-%v.sh", ctx.ID())
+	writeSession, err := s.remoteClient.NewSession()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer writeSession.Close()
+
+	writeCmd := fmt.Sprintf("cat > %s <<'TELEPORT_EOF'\n%sTELEPORT_EOF\n", shimPath, shim)
+	if err := writeSession.Run(writeCmd); err != nil {
+		return trace.Wrap(err)
+	}
+
+	return trace.Wrap(s.remoteSession.Setenv("BASH_ENV", shimPath))
+}
+
+// startEnhancedRecording opens a one-shot telemetry listener on the
+// address the remote host sees us as (so the shim can reach it over the
+// same network path used for the SSH connection itself), accepts the
+// shim's single connection in the background, and returns the shim source
+// filled in with that listener's address.
+func (s *Server) startEnhancedRecording(ctx *srv.ServerContext) (string, error) {
+	host, _, err := net.SplitHostPort(s.remoteClient.LocalAddr().String())
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	ctx.AddCloser(listener)
+
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		listener.Close()
+		return "", trace.Wrap(err)
+	}
+
+	go s.acceptEnhancedEvents(ctx, listener)
+
+	return fmt.Sprintf(enhancedRecordingShim, host, port), nil
+}
+
+// acceptEnhancedEvents accepts the shim's single telemetry connection,
+// parses each NDJSON line it sends, emits it through the audit log as the
+// matching session.command/session.disk/session.network event, and
+// mirrors the raw line to any "x-teleport-enhanced-events" subscribers.
+func (s *Server) acceptEnhancedEvents(ctx *srv.ServerContext, listener net.Listener) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+
+		var fields events.EventFields
+		if err := json.Unmarshal(line, &fields); err != nil {
+			ctx.Warningf("Failed to parse enhanced recording event: %v", err)
+			continue
+		}
+
+		switch fields["type"] {
+		case "command":
+			s.EmitAuditEvent(events.SessionCommandEvent, fields)
+		case "disk":
+			s.EmitAuditEvent(events.SessionDiskEvent, fields)
+		case "network":
+			s.EmitAuditEvent(events.SessionNetworkEvent, fields)
+		}
+
+		s.broadcastEnhancedEvent(append(append([]byte(nil), line...), '\n'))
+	}
+}
+
 func (s *Server) handleEnv(ch ssh.Channel, req *ssh.Request, ctx *srv.ServerContext) error {
 	var e sshutils.EnvReqParams
 	if err := ssh.Unmarshal(req.Payload, &e); err != nil {
@@ -579,6 +1337,148 @@ func (s *Server) handleEnv(ch ssh.Channel, req *ssh.Request, ctx *srv.ServerCont
 	return nil
 }
 
+// idleTrackingChannel wraps an ssh.Channel, recording the time of the last
+// Read or Write so a watcher can enforce a client-facing idle timeout
+// independently of any timeout applied to the upstream connection.
+type idleTrackingChannel struct {
+	ssh.Channel
+	lastActive int64 // unix nanoseconds, accessed atomically
+}
+
+func newIdleTrackingChannel(ch ssh.Channel) *idleTrackingChannel {
+	return &idleTrackingChannel{
+		Channel:    ch,
+		lastActive: time.Now().UnixNano(),
+	}
+}
+
+func (c *idleTrackingChannel) Read(p []byte) (int, error) {
+	n, err := c.Channel.Read(p)
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+	return n, err
+}
+
+func (c *idleTrackingChannel) Write(p []byte) (int, error) {
+	n, err := c.Channel.Write(p)
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+	return n, err
+}
+
+func (c *idleTrackingChannel) idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActive)))
+}
+
+// sessionMonitorInterval is how often monitorSession re-checks idle
+// timeout, max session duration, and certificate validity.
+const sessionMonitorInterval = 10 * time.Second
+
+// monitorSession enforces the RBAC-driven client_idle_timeout and
+// max_session_ttl limits on the client-facing side of the session, and
+// periodically re-validates the user's certificate and roles against
+// authClient so a mid-session lock or role revocation ends the session
+// instead of being silently ignored until the user reconnects. It signals
+// termination by sending a reason on terminate, and exits once stop is
+// closed.
+func (s *Server) monitorSession(ctx *srv.ServerContext, tracked *idleTrackingChannel, terminate chan<- string, stop <-chan struct{}) {
+	idleTimeout := ctx.Identity.RoleSet.AdjustClientIdleTimeout(defaults.DefaultIdleConnectionDuration)
+	maxDuration := ctx.Identity.RoleSet.AdjustSessionTTL(defaults.CertDuration)
+	start := time.Now()
+
+	ticker := time.NewTicker(sessionMonitorInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if idleTimeout > 0 && tracked.idleFor() > idleTimeout {
+				terminate <- "idle"
+				return
+			}
+			if maxDuration > 0 && time.Since(start) > maxDuration {
+				terminate <- "expired"
+				return
+			}
+			if err := s.checkCertStillValid(ctx); err != nil {
+				ctx.Warningf("Ending session, certificate no longer valid: %v", err)
+				terminate <- "revoked"
+				return
+			}
+		}
+	}
+}
+
+// terminateSession writes a user-visible disconnect message and emits a
+// session.end audit event tagged with the reason. It does not close the
+// session context; handleSessionRequests does that when it returns.
+func (s *Server) terminateSession(ctx *srv.ServerContext, ch ssh.Channel, reason string) {
+	var message string
+	switch reason {
+	case "idle":
+		message = "session has been idle too long, disconnecting"
+	case "expired":
+		message = "session has exceeded its maximum duration, disconnecting"
+	case "revoked":
+		message = "your credentials are no longer valid, disconnecting"
+	default:
+		message = "session terminated"
+	}
+
+	ctx.Warningf("Terminating session: %v", reason)
+	ch.Stderr().Write([]byte(message + "\r\n"))
+
+	s.EmitAuditEvent(events.SessionEndEvent, events.EventFields{
+		events.EventLogin:     ctx.Login,
+		events.SessionEventID: ctx.SessionID(),
+		events.Reason:         reason,
+	})
+}
+
+// checkCertStillValid re-checks the user's certificate expiry, their
+// *current* role assignments, and any lock placed on the user or one of
+// their roles since the session started, returning an error the moment any
+// of these mean access should no longer be granted. This is what actually
+// lets a mid-session lock or role change end the session -- checking
+// whether a role of the same name still exists anywhere in the cluster, as
+// an earlier version of this function did, only ever catches a hard role
+// deletion.
+func (s *Server) checkCertStillValid(ctx *srv.ServerContext) error {
+	if ctx.Identity.CertValidBefore.Before(time.Now()) {
+		return trace.AccessDenied("certificate has expired")
+	}
+
+	user, err := s.authClient.GetUser(ctx.Identity.TeleportUser, false)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	currentRoles := make(map[string]bool, len(user.GetRoles()))
+	for _, role := range user.GetRoles() {
+		currentRoles[role] = true
+	}
+	for _, assigned := range ctx.Identity.RoleSet {
+		if !currentRoles[assigned.GetName()] {
+			return trace.AccessDenied("role %v is no longer assigned to %v", assigned.GetName(), ctx.Identity.TeleportUser)
+		}
+	}
+
+	targets := make([]services.LockTarget, 0, len(user.GetRoles())+1)
+	targets = append(targets, services.LockTarget{User: ctx.Identity.TeleportUser})
+	for _, role := range user.GetRoles() {
+		targets = append(targets, services.LockTarget{Role: role})
+	}
+	locks, err := s.authClient.GetLocks(true, targets...)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if len(locks) > 0 {
+		return trace.AccessDenied("access for %v has been locked", ctx.Identity.TeleportUser)
+	}
+
+	return nil
+}
+
 func (s *Server) replyError(ch ssh.Channel, req *ssh.Request, err error) {
 	s.log.Error(err)
 	message := []byte(utils.UserMessageFromError(err))
@@ -597,3 +1497,158 @@ func parseSubsystemRequest(req *ssh.Request, ctx *srv.ServerContext) (*remoteSub
 
 	return parseRemoteSubsystem(context.Background(), r.Name, ctx), nil
 }
+
+const (
+	// chunkBufferSize is how many session chunks sessionChunkFlusher will
+	// buffer in memory before falling back to spooling to disk.
+	chunkBufferSize = 1024
+	// spoolRetryInitialDelay and spoolRetryMaxDelay bound the exponential
+	// backoff used when retrying chunks that failed to reach the recorder.
+	spoolRetryInitialDelay = time.Second
+	spoolRetryMaxDelay     = time.Minute
+)
+
+// sessionChunkFlusher decouples the SSH data path from the (possibly slow
+// or temporarily unavailable) session recording backend. Chunks are
+// queued in memory and written to the recorder in the background; chunks
+// that fail to flush are spooled to local disk and retried with
+// exponential backoff until the backend is reachable again.
+type sessionChunkFlusher struct {
+	log      *log.Entry
+	recorder srv.SessionRecorder
+	spoolDir string
+
+	buf  chan srv.SessionChunk
+	done chan struct{}
+
+	// retrying is non-zero while a retrySpooled loop is already running, so
+	// a run of failed deliveries kicks off at most one retry goroutine
+	// instead of one per failed chunk.
+	retrying int32
+}
+
+func newSessionChunkFlusher(log *log.Entry, recorder srv.SessionRecorder, spoolDir string) *sessionChunkFlusher {
+	f := &sessionChunkFlusher{
+		log:      log,
+		recorder: recorder,
+		spoolDir: spoolDir,
+		buf:      make(chan srv.SessionChunk, chunkBufferSize),
+		done:     make(chan struct{}),
+	}
+	go f.run()
+	// replay anything an earlier connection (or an earlier run of the
+	// proxy) left in the spool directory.
+	f.kickRetry()
+	return f
+}
+
+// Write queues a chunk for asynchronous delivery to the recorder. It never
+// blocks on the backend: if the in-memory buffer is full, the chunk is
+// spooled to disk immediately instead of stalling the SSH copy loop that
+// produced it.
+func (f *sessionChunkFlusher) Write(chunk srv.SessionChunk) {
+	select {
+	case f.buf <- chunk:
+	default:
+		if err := f.spool(chunk); err != nil {
+			f.log.Warnf("Failed to spool session chunk, dropping: %v", err)
+		}
+	}
+}
+
+func (f *sessionChunkFlusher) run() {
+	for {
+		select {
+		case chunk := <-f.buf:
+			f.deliver(chunk)
+		case <-f.done:
+			return
+		}
+	}
+}
+
+// deliver writes a chunk to the recorder, spooling it to disk and kicking
+// off a background retry if the backend rejects it.
+func (f *sessionChunkFlusher) deliver(chunk srv.SessionChunk) {
+	if err := f.recorder.WriteChunk(chunk); err == nil {
+		return
+	}
+
+	if err := f.spool(chunk); err != nil {
+		f.log.Warnf("Failed to spool session chunk, dropping: %v", err)
+		return
+	}
+
+	f.kickRetry()
+}
+
+func (f *sessionChunkFlusher) spool(chunk srv.SessionChunk) error {
+	return trace.Wrap(utils.WriteSpoolChunk(f.spoolDir, chunk))
+}
+
+// kickRetry starts retrySpooled in the background unless one is already
+// running. Every failed delivery calls this, but under a sustained backend
+// outage that must still result in a single coordinated retry loop, not one
+// goroutine per failed chunk racing over the same spool directory.
+func (f *sessionChunkFlusher) kickRetry() {
+	if !atomic.CompareAndSwapInt32(&f.retrying, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&f.retrying, 0)
+		f.retrySpooled()
+	}()
+}
+
+// retrySpooled replays spooled chunks against the recorder, backing off
+// exponentially between attempts, so a proxy restart or a transient
+// backend outage never loses a recording. kickRetry allows only one
+// instance per flusher at a time; flushers of other connections that share
+// the same spool directory are not coordinated with.
+func (f *sessionChunkFlusher) retrySpooled() {
+	delay := spoolRetryInitialDelay
+	for {
+		chunks, err := utils.ReadSpoolChunks(f.spoolDir)
+		if err != nil {
+			f.log.Warnf("Failed to read spooled session chunks: %v", err)
+			return
+		}
+		if len(chunks) == 0 {
+			return
+		}
+
+		flushed := 0
+		for _, chunk := range chunks {
+			if err := f.recorder.WriteChunk(chunk); err != nil {
+				break
+			}
+			flushed++
+		}
+		utils.TrimSpoolChunks(f.spoolDir, flushed)
+		if flushed == len(chunks) {
+			return
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+		if delay > spoolRetryMaxDelay {
+			delay = spoolRetryMaxDelay
+		}
+	}
+}
+
+// Close stops the flusher, spooling any chunks still queued in memory so
+// they can be retried on the next connection.
+func (f *sessionChunkFlusher) Close() error {
+	close(f.done)
+	for {
+		select {
+		case chunk := <-f.buf:
+			if err := f.spool(chunk); err != nil {
+				f.log.Warnf("Failed to spool session chunk on close: %v", err)
+			}
+		default:
+			return f.recorder.Close()
+		}
+	}
+}
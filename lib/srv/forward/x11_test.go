@@ -0,0 +1,124 @@
+/*
+Copyright 2017 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forward
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+func TestPad(t *testing.T) {
+	cases := []struct {
+		n    int
+		want int
+	}{
+		{0, 0},
+		{1, 3},
+		{2, 2},
+		{3, 1},
+		{4, 0},
+		{11, 1},
+	}
+	for _, c := range cases {
+		if got := pad(c.n); got != c.want {
+			t.Errorf("pad(%d) = %d, want %d", c.n, got, c.want)
+		}
+	}
+}
+
+// x11SetupPacket builds a minimal big-endian X11 connection-setup packet
+// with the given protocol name and auth data, padded per the wire format.
+func x11SetupPacket(protoName, authData []byte) []byte {
+	header := make([]byte, 12)
+	header[0] = 'B'
+	binary.BigEndian.PutUint16(header[6:8], uint16(len(protoName)))
+	binary.BigEndian.PutUint16(header[8:10], uint16(len(authData)))
+
+	buf := make([]byte, 0, len(header)+len(protoName)+pad(len(protoName))+len(authData)+pad(len(authData)))
+	buf = append(buf, header...)
+	buf = append(buf, protoName...)
+	buf = append(buf, make([]byte, pad(len(protoName)))...)
+	buf = append(buf, authData...)
+	buf = append(buf, make([]byte, pad(len(authData)))...)
+	return buf
+}
+
+func TestRewriteX11CookieReplacesKnownCookie(t *testing.T) {
+	spoofed := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	real := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	spoofedBytes, err := hex.DecodeString(spoofed)
+	if err != nil {
+		t.Fatalf("decoding spoofed cookie: %v", err)
+	}
+
+	src := bytes.NewReader(x11SetupPacket([]byte("MIT-MAGIC-COOKIE-1"), spoofedBytes))
+	dst := &bytes.Buffer{}
+
+	getReal := func(got string) (string, bool) {
+		if got != spoofed {
+			return "", false
+		}
+		return real, true
+	}
+
+	if err := rewriteX11Cookie(src, dst, getReal); err != nil {
+		t.Fatalf("rewriteX11Cookie returned error: %v", err)
+	}
+
+	wantCookie, err := hex.DecodeString(real)
+	if err != nil {
+		t.Fatalf("decoding real cookie: %v", err)
+	}
+	if !bytes.Contains(dst.Bytes(), wantCookie) {
+		t.Errorf("rewritten packet does not contain real cookie %v", real)
+	}
+	if bytes.Contains(dst.Bytes(), spoofedBytes) {
+		t.Errorf("rewritten packet still contains spoofed cookie %v", spoofed)
+	}
+}
+
+func TestRewriteX11CookieLeavesUnknownCookieAlone(t *testing.T) {
+	unknown := "cccccccccccccccccccccccccccccccc"
+	unknownBytes, err := hex.DecodeString(unknown)
+	if err != nil {
+		t.Fatalf("decoding unknown cookie: %v", err)
+	}
+
+	src := bytes.NewReader(x11SetupPacket([]byte("MIT-MAGIC-COOKIE-1"), unknownBytes))
+	dst := &bytes.Buffer{}
+
+	getReal := func(string) (string, bool) { return "", false }
+
+	if err := rewriteX11Cookie(src, dst, getReal); err != nil {
+		t.Fatalf("rewriteX11Cookie returned error: %v", err)
+	}
+	if !bytes.Contains(dst.Bytes(), unknownBytes) {
+		t.Errorf("rewritten packet dropped the original cookie when no mapping was found")
+	}
+}
+
+func TestRewriteX11CookieShortReadErrors(t *testing.T) {
+	src := bytes.NewReader([]byte{0, 1, 2})
+	dst := &bytes.Buffer{}
+
+	err := rewriteX11Cookie(src, dst, func(string) (string, bool) { return "", false })
+	if err == nil {
+		t.Fatal("expected an error reading a truncated setup packet, got nil")
+	}
+}